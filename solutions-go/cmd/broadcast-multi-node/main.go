@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"math"
+	"math/rand"
 	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aalekhpatel07/maelstrom-fly-io/solutions-go/internal/obs"
 )
 
 type BroadcastMessage struct {
@@ -12,6 +21,14 @@ type BroadcastMessage struct {
 	Message uint64 `json:"message"`
 }
 
+// GossipMessage carries a batch of newly-seen message values between a
+// node and one of its neighbors, replacing one broadcast RPC per value
+// with a single flush of everything accumulated since the last one.
+type GossipMessage struct {
+	Type     string   `json:"type"`
+	Messages []uint64 `json:"messages"`
+}
+
 type TopologyMessage struct {
 	Type     string              `json:"type"`
 	Topology map[string][]string `json:"topology"`
@@ -22,6 +39,20 @@ type ReadOkMessage struct {
 	Messages []uint64 `json:"messages"`
 }
 
+// SyncReqMessage carries a digest of the sender's known message IDs so
+// the receiver can work out what it's missing.
+type SyncReqMessage struct {
+	Type   string   `json:"type"`
+	Digest []uint64 `json:"digest"`
+}
+
+// SyncRespMessage carries the values the receiver had that were absent
+// from the requester's digest.
+type SyncRespMessage struct {
+	Type     string   `json:"type"`
+	Messages []uint64 `json:"messages"`
+}
+
 type EmptyOkMessage struct {
 	Type string `json:"type"`
 }
@@ -31,9 +62,399 @@ type void struct{}
 
 var member void
 
+// rpcTimeout bounds how long we wait for a neighbor to ack a gossip
+// flush before giving up and retrying it.
+const rpcTimeout = 1 * time.Second
+
+// defaultGossipInterval is how often a neighbor's pending values are
+// flushed as a gossip batch when the threshold isn't hit first.
+// Override with the GOSSIP_INTERVAL_MS env var.
+const defaultGossipInterval = 200 * time.Millisecond
+
+// gossipBatchThreshold flushes a neighbor's queue immediately, without
+// waiting for the next tick, once this many values are pending.
+const gossipBatchThreshold = 100
+
+// antiEntropyInterval is how often a node picks a random peer and
+// reconciles its message set against it, guaranteeing convergence even
+// if direct broadcast/gossip sends to that peer were lost.
+const antiEntropyInterval = 5 * time.Second
+
+// overlay identifies which neighbor-selection strategy to use instead
+// of the topology Maelstrom hands us, so a single
+// binary can be benchmarked under different overlays. Select one with
+// the TOPOLOGY_STRATEGY env var.
+type overlay string
+
+const (
+	overlayPassthrough  overlay = "passthrough"
+	overlaySpanningTree overlay = "spanning-tree"
+	overlayGrid         overlay = "grid"
+	overlayRandomK      overlay = "random-k"
+)
+
+// defaultRandomK is how many peers each node keeps under the random-k
+// overlay. Override with TOPOLOGY_RANDOM_K.
+const defaultRandomK = 3
+
+// defaultRandomKInterval is how often the random-k overlay reshuffles
+// its peer set. Override with TOPOLOGY_RANDOM_INTERVAL_MS.
+const defaultRandomKInterval = 10 * time.Second
+
+func selectedOverlay() overlay {
+	switch overlay(os.Getenv("TOPOLOGY_STRATEGY")) {
+	case overlaySpanningTree:
+		return overlaySpanningTree
+	case overlayGrid:
+		return overlayGrid
+	case overlayRandomK:
+		return overlayRandomK
+	default:
+		return overlayPassthrough
+	}
+}
+
+func randomKCount() int {
+	k, err := strconv.Atoi(os.Getenv("TOPOLOGY_RANDOM_K"))
+	if err != nil || k <= 0 {
+		return defaultRandomK
+	}
+	return k
+}
+
+func randomKInterval() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("TOPOLOGY_RANDOM_INTERVAL_MS"))
+	if err != nil || ms <= 0 {
+		return defaultRandomKInterval
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// applyOverlay computes this node's neighbor set under the selected
+// strategy and installs it into state, launching a reshuffling
+// goroutine for strategies that change over time.
+func applyOverlay(node *maelstrom.Node, state *State, given map[string][]string) {
+	switch selectedOverlay() {
+	case overlaySpanningTree:
+		setNeighbors(state, spanningTreeNeighbors(node))
+	case overlayGrid:
+		setNeighbors(state, gridNeighbors(node))
+	case overlayRandomK:
+		k := randomKCount()
+		setNeighbors(state, randomKNeighbors(node, k))
+		go reshuffleRandomK(node, state, k, randomKInterval())
+	default:
+		setNeighbors(state, given[node.ID()])
+	}
+}
+
+func setNeighbors(state *State, neighbors []string) {
+	state.mu.Lock()
+	state.Neighbors = neighbors
+	state.mu.Unlock()
+}
+
+func reshuffleRandomK(node *maelstrom.Node, state *State, k int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		setNeighbors(state, randomKNeighbors(node, k))
+	}
+}
+
+// spanningTreeNeighbors arranges the cluster into a binary tree rooted
+// at the lowest node ID: for a node at sorted index i, its parent is at
+// (i-1)/2 and its children are at 2i+1 and 2i+2.
+func spanningTreeNeighbors(node *maelstrom.Node) []string {
+	ids := sortedNodeIDs(node)
+	idx := indexOf(ids, node.ID())
+	if idx < 0 {
+		return nil
+	}
+
+	neighbors := make([]string, 0, 3)
+	if idx > 0 {
+		neighbors = append(neighbors, ids[(idx-1)/2])
+	}
+	for _, child := range []int{2*idx + 1, 2*idx + 2} {
+		if child < len(ids) {
+			neighbors = append(neighbors, ids[child])
+		}
+	}
+	return neighbors
+}
+
+// gridNeighbors arranges the cluster into a ceil(sqrt(N)) x ceil(sqrt(N))
+// mesh and returns this node's up/down/left/right grid neighbors.
+func gridNeighbors(node *maelstrom.Node) []string {
+	ids := sortedNodeIDs(node)
+	idx := indexOf(ids, node.ID())
+	if idx < 0 {
+		return nil
+	}
+
+	width := int(math.Ceil(math.Sqrt(float64(len(ids)))))
+	row, col := idx/width, idx%width
+
+	neighbors := make([]string, 0, 4)
+	addIfPresent := func(r, c int) {
+		i := r*width + c
+		if r >= 0 && c >= 0 && c < width && i >= 0 && i < len(ids) && i != idx {
+			neighbors = append(neighbors, ids[i])
+		}
+	}
+	addIfPresent(row-1, col)
+	addIfPresent(row+1, col)
+	addIfPresent(row, col-1)
+	addIfPresent(row, col+1)
+	return neighbors
+}
+
+// randomKNeighbors picks k random peers other than this node.
+func randomKNeighbors(node *maelstrom.Node, k int) []string {
+	ids := node.NodeIDs()
+	candidates := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != node.ID() {
+			candidates = append(candidates, id)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if k > len(candidates) {
+		k = len(candidates)
+	}
+	return append([]string(nil), candidates[:k]...)
+}
+
+func sortedNodeIDs(node *maelstrom.Node) []string {
+	ids := append([]string(nil), node.NodeIDs()...)
+	sort.Strings(ids)
+	return ids
+}
+
+func indexOf(ids []string, id string) int {
+	for i, candidate := range ids {
+		if candidate == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// gossipInterval reads the configurable flush interval from
+// GOSSIP_INTERVAL_MS, falling back to defaultGossipInterval.
+func gossipInterval() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("GOSSIP_INTERVAL_MS"))
+	if err != nil || ms <= 0 {
+		return defaultGossipInterval
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// outboundQueue is a per-neighbor set of messages still awaiting a
+// gossip_ok, deduplicated so re-enqueuing an in-flight message is a
+// no-op. notify wakes the neighbor's replication worker.
+type outboundQueue struct {
+	mu      sync.Mutex
+	pending Set
+	notify  chan struct{}
+}
+
+func newOutboundQueue() *outboundQueue {
+	return &outboundQueue{
+		pending: make(Set),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func (q *outboundQueue) enqueue(message uint64) {
+	q.mu.Lock()
+	q.pending[message] = member
+	q.mu.Unlock()
+	q.wake()
+}
+
+func (q *outboundQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *outboundQueue) snapshot() []uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	out := make([]uint64, 0, len(q.pending))
+	for m := range q.pending {
+		out = append(out, m)
+	}
+	return out
+}
+
+func (q *outboundQueue) ack(messages []uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, m := range messages {
+		delete(q.pending, m)
+	}
+}
+
 type State struct {
+	mu        sync.Mutex
 	Neighbors []string
 	Messages  Set
+	queues    map[string]*outboundQueue
+	metrics   *obs.Metrics
+}
+
+// Digest returns a sorted snapshot of every message ID known locally,
+// suitable for sending to a peer so it can tell us what we're missing.
+func (s *State) Digest() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	digest := make([]uint64, 0, len(s.Messages))
+	for m := range s.Messages {
+		digest = append(digest, m)
+	}
+	sort.Slice(digest, func(i, j int) bool { return digest[i] < digest[j] })
+	return digest
+}
+
+// Diff returns the locally-known messages absent from peerDigest.
+func (s *State) Diff(peerDigest []uint64) []uint64 {
+	known := make(Set, len(peerDigest))
+	for _, m := range peerDigest {
+		known[m] = member
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	missing := make([]uint64, 0)
+	for m := range s.Messages {
+		if _, ok := known[m]; !ok {
+			missing = append(missing, m)
+		}
+	}
+	return missing
+}
+
+// Merge adds values into the local message set and returns whichever of
+// them weren't already known, so the caller can decide what's worth
+// propagating further.
+func (s *State) Merge(values []uint64) []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newValues := make([]uint64, 0, len(values))
+	for _, m := range values {
+		if _, ok := s.Messages[m]; !ok {
+			s.Messages[m] = member
+			newValues = append(newValues, m)
+		}
+	}
+	return newValues
+}
+
+// queueFor returns the outbound queue for neighbor, starting its
+// replication worker the first time it's needed.
+func (s *State) queueFor(node *maelstrom.Node, neighbor string) *outboundQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[neighbor]
+	if !ok {
+		q = newOutboundQueue()
+		s.queues[neighbor] = q
+		go replicate(node, neighbor, q, s.metrics)
+	}
+	return q
+}
+
+// replicate flushes neighbor's outbound queue as a gossip batch on a
+// timer, or immediately once the queue crosses gossipBatchThreshold.
+// Values that fail to send or aren't acked stay pending for the next
+// flush, so nothing is lost to a single failed round.
+func replicate(node *maelstrom.Node, neighbor string, queue *outboundQueue, metrics *obs.Metrics) {
+	ticker := time.NewTicker(gossipInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			flushGossip(node, neighbor, queue, metrics)
+		case <-queue.notify:
+			if len(queue.snapshot()) >= gossipBatchThreshold {
+				flushGossip(node, neighbor, queue, metrics)
+			}
+		}
+	}
+}
+
+func flushGossip(node *maelstrom.Node, neighbor string, queue *outboundQueue, metrics *obs.Metrics) {
+	pending := queue.snapshot()
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	reply, err := node.SyncRPC(ctx, neighbor, GossipMessage{Type: "gossip", Messages: pending})
+	cancel()
+	if err != nil {
+		metrics.IncRetried()
+		return
+	}
+
+	var replyBody EmptyOkMessage
+	if err := json.Unmarshal(reply.Body, &replyBody); err != nil || replyBody.Type != "gossip_ok" {
+		metrics.IncRetried()
+		return
+	}
+	queue.ack(pending)
+}
+
+// antiEntropy periodically picks a random peer and exchanges digests
+// with it via sync_req/sync_resp, merging back anything it had that we
+// didn't. Run as a background goroutine for the life of the node.
+func antiEntropy(node *maelstrom.Node, state *State) {
+	ticker := time.NewTicker(antiEntropyInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		peer := randomPeer(node)
+		if peer == "" {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+		reply, err := node.SyncRPC(ctx, peer, SyncReqMessage{Type: "sync_req", Digest: state.Digest()})
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		var resp SyncRespMessage
+		if err := json.Unmarshal(reply.Body, &resp); err != nil {
+			continue
+		}
+		state.Merge(resp.Messages)
+	}
+}
+
+// randomPeer picks a random node other than ourselves from the cluster
+// membership, or "" if there are no other nodes yet.
+func randomPeer(node *maelstrom.Node) string {
+	ids := node.NodeIDs()
+	candidates := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != node.ID() {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[rand.Intn(len(candidates))]
 }
 
 func startNode(node *maelstrom.Node) {
@@ -47,51 +468,80 @@ func main() {
 	node := maelstrom.NewNode()
 	defer startNode(node)
 
+	metrics := obs.NewMetrics()
 	state := State{
 		Neighbors: make([]string, 0),
 		Messages:  make(Set),
+		queues:    make(map[string]*outboundQueue),
+		metrics:   metrics,
 	}
+	go antiEntropy(node, &state)
 
-	node.Handle("topology", func(msg maelstrom.Message) error {
+	obs.RegisterStats(node, metrics)
+
+	obs.Handle(node, metrics, "topology", func(msg maelstrom.Message) error {
 		var message TopologyMessage
 		if err := json.Unmarshal(msg.Body, &message); err != nil {
 			return err
 		}
-		state.Neighbors = message.Topology[node.ID()]
+		applyOverlay(node, &state, message.Topology)
 		return node.Reply(msg, EmptyOkMessage{Type: "topology_ok"})
 	})
 
-	node.Handle("broadcast", func(msg maelstrom.Message) error {
+	obs.Handle(node, metrics, "broadcast", func(msg maelstrom.Message) error {
 		var message BroadcastMessage
 		if err := json.Unmarshal(msg.Body, &message); err != nil {
 			return err
 		}
 
-		_, ok := state.Messages[message.Message]
+		newValues := state.Merge([]uint64{message.Message})
+
+		state.mu.Lock()
+		neighbors := state.Neighbors
+		state.mu.Unlock()
 
-		if ok {
-			return node.Reply(msg, EmptyOkMessage{Type: "broadcast_ok"})
+		if len(newValues) > 0 {
+			for _, neighbor := range neighbors {
+				if neighbor != msg.Src {
+					state.queueFor(node, neighbor).enqueue(message.Message)
+				}
+			}
 		}
+		return node.Reply(msg, EmptyOkMessage{Type: "broadcast_ok"})
+	})
 
-		state.Messages[message.Message] = member
+	obs.Handle(node, metrics, "gossip", func(msg maelstrom.Message) error {
+		var message GossipMessage
+		if err := json.Unmarshal(msg.Body, &message); err != nil {
+			return err
+		}
 
-		for _, neighbor := range state.Neighbors {
-			if neighbor != msg.Src {
+		newMessages := state.Merge(message.Messages)
 
-				var payload BroadcastMessage
-				payload.Type = "broadcast"
-				payload.Message = message.Message
+		state.mu.Lock()
+		neighbors := state.Neighbors
+		state.mu.Unlock()
 
-				if err := node.Send(neighbor, payload); err != nil {
-					fmt.Printf("Error sending payload to neighbor %s: %s", neighbor, err)
-					os.Exit(1)
+		for _, neighbor := range neighbors {
+			if neighbor != msg.Src {
+				q := state.queueFor(node, neighbor)
+				for _, m := range newMessages {
+					q.enqueue(m)
 				}
 			}
 		}
-		return node.Reply(msg, EmptyOkMessage{Type: "broadcast_ok"})
+		return node.Reply(msg, EmptyOkMessage{Type: "gossip_ok"})
 	})
 
-	node.Handle("read", func(msg maelstrom.Message) error {
+	obs.Handle(node, metrics, "sync_req", func(msg maelstrom.Message) error {
+		var message SyncReqMessage
+		if err := json.Unmarshal(msg.Body, &message); err != nil {
+			return err
+		}
+		return node.Reply(msg, SyncRespMessage{Type: "sync_resp", Messages: state.Diff(message.Digest)})
+	})
+
+	obs.Handle(node, metrics, "read", func(msg maelstrom.Message) error {
 		var message map[string]any
 		if err := json.Unmarshal(msg.Body, &message); err != nil {
 			return err
@@ -100,13 +550,11 @@ func main() {
 			Type:     "read_ok",
 			Messages: make([]uint64, 0),
 		}
+		state.mu.Lock()
 		for m := range state.Messages {
 			payload.Messages = append(payload.Messages, m)
 		}
+		state.mu.Unlock()
 		return node.Reply(msg, payload)
 	})
-
-	node.Handle("broadcast_ok", func(msg maelstrom.Message) error {
-		return nil
-	})
 }
@@ -6,6 +6,8 @@ import (
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 	"os"
 	"sync"
+
+	"github.com/aalekhpatel07/maelstrom-fly-io/solutions-go/internal/obs"
 )
 
 type BroadcastMessage struct {
@@ -54,7 +56,10 @@ func main() {
 		Messages:  make(Set),
 	}
 
-	node.Handle("topology", func(msg maelstrom.Message) error {
+	metrics := obs.NewMetrics()
+	obs.RegisterStats(node, metrics)
+
+	obs.Handle(node, metrics, "topology", func(msg maelstrom.Message) error {
 		var message TopologyMessage
 		if err := json.Unmarshal(msg.Body, &message); err != nil {
 			return err
@@ -65,7 +70,7 @@ func main() {
 		return node.Reply(msg, EmptyOkMessage{Type: "topology_ok"})
 	})
 
-	node.Handle("broadcast", func(msg maelstrom.Message) error {
+	obs.Handle(node, metrics, "broadcast", func(msg maelstrom.Message) error {
 		var message BroadcastMessage
 		if err := json.Unmarshal(msg.Body, &message); err != nil {
 			return err
@@ -77,7 +82,7 @@ func main() {
 		return node.Reply(msg, EmptyOkMessage{Type: "broadcast_ok"})
 	})
 
-	node.Handle("read", func(msg maelstrom.Message) error {
+	obs.Handle(node, metrics, "read", func(msg maelstrom.Message) error {
 		var message map[string]any
 		if err := json.Unmarshal(msg.Body, &message); err != nil {
 			return err
@@ -4,30 +4,96 @@ import (
 	"encoding/json"
 	"fmt"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"hash/fnv"
 	"os"
-	"sync/atomic"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aalekhpatel07/maelstrom-fly-io/solutions-go/internal/obs"
+)
+
+// Snowflake-style 64-bit ID layout: [timestamp_ms:41][node_index:10][sequence:12].
+// This makes IDs k-sortable and globally unique without coordination,
+// and unlike a restart-reset counter, survives a node crash-restart
+// without risking a collision against IDs it already handed out.
+const (
+	nodeIndexBits = 10
+	sequenceBits  = 12
+	sequenceMask  = 1<<sequenceBits - 1
+	nodeIndexMask = 1<<nodeIndexBits - 1
 )
 
 type State struct {
-	Counter uint64
-	Node    *maelstrom.Node
+	Node *maelstrom.Node
+
+	mu         sync.Mutex
+	lastMillis int64
+	sequence   uint64
+
+	indexOnce sync.Once
+	nodeIndex uint64
+}
+
+// nextID blocks until the local clock ticks forward whenever the
+// sequence counter for the current millisecond is exhausted, rather
+// than ever reusing a (timestamp, node_index, sequence) triple.
+func (s *State) nextID() uint64 {
+	for {
+		now := time.Now().UnixMilli()
+
+		s.mu.Lock()
+		if now == s.lastMillis {
+			s.sequence = (s.sequence + 1) & sequenceMask
+			if s.sequence == 0 {
+				s.mu.Unlock()
+				time.Sleep(time.Millisecond)
+				continue
+			}
+		} else {
+			s.lastMillis = now
+			s.sequence = 0
+		}
+		millis, seq := s.lastMillis, s.sequence
+		s.mu.Unlock()
+
+		return uint64(millis)<<(nodeIndexBits+sequenceBits) | s.nodeIndex<<sequenceBits | seq
+	}
+}
+
+// nodeIndexFor derives a stable 10-bit index for this node from its
+// position among the cluster's node IDs, falling back to a hash of the
+// ID itself if the membership list isn't available yet.
+func nodeIndexFor(node *maelstrom.Node) uint64 {
+	ids := append([]string(nil), node.NodeIDs()...)
+	sort.Strings(ids)
+	for i, id := range ids {
+		if id == node.ID() {
+			return uint64(i) & nodeIndexMask
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(node.ID()))
+	return uint64(h.Sum32()) & nodeIndexMask
 }
 
 func main() {
 	node := maelstrom.NewNode()
-	state := State{
-		Counter: 0,
-		Node:    node,
-	}
+	state := State{Node: node}
+
+	metrics := obs.NewMetrics()
+	obs.RegisterStats(node, metrics)
 
-	state.Node.Handle("generate", func(msg maelstrom.Message) error {
+	obs.Handle(node, metrics, "generate", func(msg maelstrom.Message) error {
 		var body map[string]any
 		if err := json.Unmarshal(msg.Body, &body); err != nil {
 			return err
 		}
-		atomic.AddUint64(&state.Counter, 1)
+		state.indexOnce.Do(func() { state.nodeIndex = nodeIndexFor(node) })
 		body["type"] = "generate_ok"
-		body["id"] = fmt.Sprintf("%s-%4d", state.Node.ID(), state.Counter)
+		body["id"] = strconv.FormatUint(state.nextID(), 10)
 		return state.Node.Reply(msg, body)
 	})
 
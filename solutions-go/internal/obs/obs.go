@@ -0,0 +1,110 @@
+// Package obs provides structured logging and in-memory metrics shared
+// across the challenge binaries, so each one doesn't have to
+// re-instrument its own handlers to debug convergence or latency issues
+// during a Maelstrom run.
+package obs
+
+import (
+	"encoding/json"
+	"fmt"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics accumulates handler-level counters for a node's lifetime.
+type Metrics struct {
+	handled uint64
+	replied uint64
+	dropped uint64
+	retried uint64
+}
+
+// NewMetrics returns a zeroed Metrics ready for use.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Counters is a point-in-time snapshot of a Metrics, safe to marshal.
+type Counters struct {
+	Handled uint64 `json:"handled"`
+	Replied uint64 `json:"replied"`
+	Dropped uint64 `json:"dropped"`
+	Retried uint64 `json:"retried"`
+}
+
+func (m *Metrics) Snapshot() Counters {
+	return Counters{
+		Handled: atomic.LoadUint64(&m.handled),
+		Replied: atomic.LoadUint64(&m.replied),
+		Dropped: atomic.LoadUint64(&m.dropped),
+		Retried: atomic.LoadUint64(&m.retried),
+	}
+}
+
+func (m *Metrics) IncHandled() { atomic.AddUint64(&m.handled, 1) }
+func (m *Metrics) IncReplied() { atomic.AddUint64(&m.replied, 1) }
+func (m *Metrics) IncDropped() { atomic.AddUint64(&m.dropped, 1) }
+func (m *Metrics) IncRetried() { atomic.AddUint64(&m.retried, 1) }
+
+// logEntry is the structured record written to stderr for every
+// handled message. stdout is reserved for Maelstrom's own protocol, so
+// all observability output goes to stderr instead.
+type logEntry struct {
+	MsgID     any    `json:"msg_id,omitempty"`
+	Src       string `json:"src"`
+	Dest      string `json:"dest"`
+	Type      string `json:"type"`
+	LatencyMs int64  `json:"latency_ms"`
+	Err       string `json:"err,omitempty"`
+}
+
+// Handle registers handler for typ on node, the same as node.Handle,
+// but wraps it to emit a structured JSON log line per message and to
+// tally the result into metrics.
+func Handle(node *maelstrom.Node, metrics *Metrics, typ string, handler func(maelstrom.Message) error) {
+	node.Handle(typ, func(msg maelstrom.Message) error {
+		start := time.Now()
+		metrics.IncHandled()
+
+		err := handler(msg)
+
+		entry := logEntry{
+			Src:       msg.Src,
+			Dest:      msg.Dest,
+			Type:      typ,
+			LatencyMs: time.Since(start).Milliseconds(),
+		}
+		var body map[string]any
+		if json.Unmarshal(msg.Body, &body) == nil {
+			entry.MsgID = body["msg_id"]
+		}
+		if err != nil {
+			entry.Err = err.Error()
+			metrics.IncDropped()
+		} else {
+			metrics.IncReplied()
+		}
+
+		if encoded, marshalErr := json.Marshal(entry); marshalErr == nil {
+			fmt.Fprintln(os.Stderr, string(encoded))
+		}
+		return err
+	})
+}
+
+// RegisterStats installs a `stats` handler on node that replies with
+// metrics's current counters in a stats_ok body.
+func RegisterStats(node *maelstrom.Node, metrics *Metrics) {
+	node.Handle("stats", func(msg maelstrom.Message) error {
+		counters := metrics.Snapshot()
+		return node.Reply(msg, map[string]any{
+			"type":    "stats_ok",
+			"handled": counters.Handled,
+			"replied": counters.Replied,
+			"dropped": counters.Dropped,
+			"retried": counters.Retried,
+		})
+	})
+}